@@ -23,10 +23,13 @@ package flexvolume
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/coreos/pkg/capnslog"
 	"github.com/rook/rook/pkg/agent/flexvolume/crd"
@@ -40,7 +43,10 @@ import (
 	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/kubernetes/pkg/util/version"
 )
 
@@ -49,6 +55,11 @@ const (
 	PoolKey               = "pool"
 	ImageKey              = "image"
 	kubeletDefaultRootDir = "/var/lib/kubelet"
+
+	// staleAttachingTimeout is how long an Attachment can stay in the Attaching state before
+	// Detach/RemoveAttachmentObject will stop waiting on it and treat it as abandoned, e.g.
+	// because the attacher crashed before calling MountDevice.
+	staleAttachingTimeout = 10 * time.Minute
 )
 
 var driverLogger = capnslog.NewPackageLogger("github.com/rook/rook", "rook-flexdriver")
@@ -56,11 +67,17 @@ var driverLogger = capnslog.NewPackageLogger("github.com/rook/rook", "rook-flexd
 // FlexvolumeController handles all events from the Flexvolume driver
 type FlexvolumeController struct {
 	clientset                  kubernetes.Interface
-	volumeManager              VolumeManager
 	volumeAttachmentController crd.VolumeAttachmentController
+	eventRecorder              record.EventRecorder
+
+	subPathLocksMu sync.Mutex
+	// subPathLocks holds the open file handles returned by resolveAndLockSubPath, keyed by
+	// mountDir, for as long as the corresponding subPath mount is live. They are released
+	// once the attachment is removed in RemoveAttachmentObject.
+	subPathLocks map[string][]io.Closer
 }
 
-func newFlexvolumeController(context *clusterd.Context, volumeAttachmentCRDClient rest.Interface, manager VolumeManager) (*FlexvolumeController, error) {
+func newFlexvolumeController(context *clusterd.Context, volumeAttachmentCRDClient rest.Interface) (*FlexvolumeController, error) {
 
 	var controller crd.VolumeAttachmentController
 	// CRD is available on v1.7.0. TPR became deprecated on v1.7.0
@@ -77,11 +94,22 @@ func newFlexvolumeController(context *clusterd.Context, volumeAttachmentCRDClien
 
 	return &FlexvolumeController{
 		clientset:                  context.Clientset,
-		volumeManager:              manager,
 		volumeAttachmentController: controller,
+		eventRecorder:              newEventRecorder(context.Clientset),
+		subPathLocks:               map[string][]io.Closer{},
 	}, nil
 }
 
+// newEventRecorder creates an EventRecorder that the controller can use to annotate pods and
+// PVs with FailedAttachVolume events so operators can see why a volume
+// is stuck without having to read the agent logs.
+func newEventRecorder(clientset kubernetes.Interface) record.EventRecorder {
+	eventBroadcaster := record.NewBroadcaster()
+	eventBroadcaster.StartLogging(logger.Infof)
+	eventBroadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: clientset.CoreV1().Events("")})
+	return eventBroadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: "rook-flexdriver"})
+}
+
 // Attach attaches rook volume to the node
 func (c *FlexvolumeController) Attach(attachOpts AttachOptions, devicePath *string) error {
 
@@ -91,6 +119,24 @@ func (c *FlexvolumeController) Attach(attachOpts AttachOptions, devicePath *stri
 	// Name of CRD is the PV name. This is done so that the CRD can be use for fencing
 	crdName := attachOpts.VolumeName
 
+	manager, err := c.volumeManagerForStorageClass(attachOpts.StorageClass)
+	if err != nil {
+		return fmt.Errorf("failed to determine volume manager for volume %s: %+v", crdName, err)
+	}
+
+	accessMode := attachOpts.AccessMode
+	if accessMode == "" {
+		// No access mode was already derived from the PV (e.g. legacy caller). Fall back to
+		// inferring one from the manager and the requested RW mode.
+		accessMode, err = accessModeFor(manager, attachOpts.RW)
+		if err != nil {
+			return fmt.Errorf("failed to determine access mode for volume %s: %+v", crdName, err)
+		}
+		attachOpts.AccessMode = accessMode
+	} else if err := validateAccessModeForManager(manager, accessMode); err != nil {
+		return fmt.Errorf("failed to attach volume %s: %+v", crdName, err)
+	}
+
 	// Check if this volume has been attached
 	volumeattachObj, err := c.volumeAttachmentController.Get(namespace, crdName)
 	if err != nil {
@@ -99,7 +145,8 @@ func (c *FlexvolumeController) Attach(attachOpts AttachOptions, devicePath *stri
 		}
 		// No volumeattach CRD for this volume found. Create one
 		volumeattachObj = crd.NewVolumeAttachment(crdName, namespace, node, attachOpts.PodNamespace, attachOpts.Pod,
-			attachOpts.MountDir, strings.ToLower(attachOpts.RW) == ReadOnly)
+			attachOpts.MountDir, strings.ToLower(attachOpts.RW) == ReadOnly,
+			attachOpts.Image, attachOpts.Pool, attachOpts.ClusterName, string(accessMode))
 		logger.Infof("Creating Volume attach Resource %s/%s: %+v", volumeattachObj.Namespace, volumeattachObj.Name, attachOpts)
 		err = c.volumeAttachmentController.Create(volumeattachObj)
 		if err != nil {
@@ -123,6 +170,32 @@ func (c *FlexvolumeController) Attach(attachOpts AttachOptions, devicePath *stri
 			}
 		}
 
+		if !found {
+			if volumeattachObj.AccessMode != "" && volumeattachObj.AccessMode != string(accessMode) {
+				return fmt.Errorf("failed to attach volume %s for pod %s/%s. Volume is already attached with access mode %s, requested %s",
+					crdName, attachOpts.PodNamespace, attachOpts.Pod, volumeattachObj.AccessMode, accessMode)
+			}
+		}
+
+		if !found && accessMode == ReadWriteMany {
+			// CephFS-backed volumes may be attached RW from any number of nodes at once.
+			newAttach := crd.Attachment{
+				Node:               node,
+				PodNamespace:       attachOpts.PodNamespace,
+				PodName:            attachOpts.Pod,
+				MountDir:           attachOpts.MountDir,
+				ReadOnly:           attachOpts.RW == ReadOnly,
+				MountState:         crd.Attaching,
+				LastTransitionTime: metav1.Now(),
+			}
+			volumeattachObj.Attachments = append(volumeattachObj.Attachments, newAttach)
+			err = c.volumeAttachmentController.Update(volumeattachObj)
+			if err != nil {
+				return fmt.Errorf("failed to update volume CRD %s. %+v", crdName, err)
+			}
+			found = true
+		}
+
 		if !found {
 			// Check if there is already an attachment with RW.
 			index := getPodRWAttachmentObject(volumeattachObj)
@@ -141,12 +214,14 @@ func (c *FlexvolumeController) Attach(attachOpts AttachOptions, devicePath *stri
 					attachment.PodNamespace = attachOpts.PodNamespace
 					attachment.PodName = attachOpts.Pod
 					attachment.ReadOnly = attachOpts.RW == ReadOnly
+					attachment.TransitionTo(crd.Attaching, metav1.Now())
 					err = c.volumeAttachmentController.Update(volumeattachObj)
 					if err != nil {
 						return fmt.Errorf("failed to update volume CRD %s. %+v", crdName, err)
 					}
 				} else {
 					// Attachment is not orphaned. Original pod still exists. Dont attach.
+					c.recordFailedAttachEvent(attachOpts, volumeattachObj)
 					return fmt.Errorf("failed to attach volume %s for pod %s/%s. Volume is already attached by pod %s/%s. Status %+v",
 						crdName, attachOpts.PodNamespace, attachOpts.Pod, attachment.PodNamespace, attachment.PodName, pod.Status.Phase)
 				}
@@ -154,17 +229,20 @@ func (c *FlexvolumeController) Attach(attachOpts AttachOptions, devicePath *stri
 				// No RW attachment found. Check if this is a RW attachment request.
 				// We only support RW once attachment. No mixing either with RO
 				if attachOpts.RW == "rw" && len(volumeattachObj.Attachments) > 0 {
+					c.recordFailedAttachEvent(attachOpts, volumeattachObj)
 					return fmt.Errorf("failed to attach volume %s for pod %s/%s. Volume is already attached by one or more pods",
 						crdName, attachOpts.PodNamespace, attachOpts.Pod)
 				}
 
 				// Create a new attachment record and proceed with attaching
 				newAttach := crd.Attachment{
-					Node:         node,
-					PodNamespace: attachOpts.PodNamespace,
-					PodName:      attachOpts.Pod,
-					MountDir:     attachOpts.MountDir,
-					ReadOnly:     attachOpts.RW == ReadOnly,
+					Node:               node,
+					PodNamespace:       attachOpts.PodNamespace,
+					PodName:            attachOpts.Pod,
+					MountDir:           attachOpts.MountDir,
+					ReadOnly:           attachOpts.RW == ReadOnly,
+					MountState:         crd.Attaching,
+					LastTransitionTime: metav1.Now(),
 				}
 				volumeattachObj.Attachments = append(volumeattachObj.Attachments, newAttach)
 				err = c.volumeAttachmentController.Update(volumeattachObj)
@@ -174,23 +252,85 @@ func (c *FlexvolumeController) Attach(attachOpts AttachOptions, devicePath *stri
 			}
 		}
 	}
-	*devicePath, err = c.volumeManager.Attach(attachOpts.Image, attachOpts.Pool, attachOpts.ClusterName)
+	*devicePath, err = manager.Attach(attachOpts.Image, attachOpts.Pool, attachOpts.ClusterName)
 	if err != nil {
 		return fmt.Errorf("failed to attach volume %s/%s: %+v", attachOpts.Pool, attachOpts.Image, err)
 	}
 	return nil
 }
 
+// MountDevice is called by the flex driver once it has successfully mounted the device at
+// mountDir, transitioning the matching Attachment from Attaching to Mounted. Until this is
+// called, Detach/RemoveAttachmentObject will refuse to run on the same node so a still
+// in-flight attach can't be unmapped out from under the mounter.
+//
+// If the pod requested a subPath, MountDevice also validates it against the volume root and
+// returns the bind-mount source in bindMountSource, so the driver script never has to construct
+// (and potentially get wrong) the subPath itself. See resolveAndLockSubPath for why that source
+// is a /proc/<pid>/fd/<n> reference rather than a plain path.
+func (c *FlexvolumeController) MountDevice(attachOpts AttachOptions, bindMountSource *string) error {
+	namespace := os.Getenv(k8sutil.PodNamespaceEnvVar)
+	crdName := attachOpts.VolumeName
+	node := os.Getenv(k8sutil.NodeNameEnvVar)
+
+	volumeAttach, err := c.volumeAttachmentController.Get(namespace, crdName)
+	if err != nil {
+		return fmt.Errorf("failed to get volume CRD %s. %+v", crdName, err)
+	}
+
+	for i, a := range volumeAttach.Attachments {
+		if a.Node != node || a.MountDir != attachOpts.MountDir {
+			continue
+		}
+
+		resolved, handles, err := resolveAndLockSubPath(attachOpts.MountDir, attachOpts.SubPath)
+		if err != nil {
+			return fmt.Errorf("failed to validate subPath for mountDir %s: %+v", attachOpts.MountDir, err)
+		}
+		*bindMountSource = resolved
+
+		volumeAttach.Attachments[i].TransitionTo(crd.Mounted, metav1.Now())
+		if err := c.volumeAttachmentController.Update(volumeAttach); err != nil {
+			closeAll(handles)
+			return err
+		}
+
+		c.subPathLocksMu.Lock()
+		// MountDevice can be retried by the driver for a mountDir it already succeeded on; close
+		// whatever handles a prior call stashed here before replacing them, or they leak forever.
+		closeAll(c.subPathLocks[attachOpts.MountDir])
+		c.subPathLocks[attachOpts.MountDir] = handles
+		c.subPathLocksMu.Unlock()
+		return nil
+	}
+	return fmt.Errorf("no attachment for mountDir %s found in volume CRD %s", attachOpts.MountDir, crdName)
+}
+
 // Detach detaches a rook volume to the node
 func (c *FlexvolumeController) Detach(detachOpts AttachOptions, _ *struct{} /* void reply */) error {
 
-	err := c.volumeManager.Detach(detachOpts.Image, detachOpts.Pool, detachOpts.ClusterName)
+	namespace := os.Getenv(k8sutil.PodNamespaceEnvVar)
+	crdName := detachOpts.VolumeName
+	node := os.Getenv(k8sutil.NodeNameEnvVar)
+	volumeAttachCheck, err := c.volumeAttachmentController.Get(namespace, crdName)
+	if err != nil {
+		return fmt.Errorf("failed to get volume CRD %s. %+v", crdName, err)
+	}
+	if blocked, attachment := hasInFlightAttachOnNode(volumeAttachCheck.Attachments, node); blocked {
+		return fmt.Errorf("volume %s still has an attach in progress for pod %s/%s on node %s. retry later",
+			crdName, attachment.PodNamespace, attachment.PodName, node)
+	}
+
+	manager, err := c.volumeManagerForStorageClass(detachOpts.StorageClass)
+	if err != nil {
+		return fmt.Errorf("failed to determine volume manager for volume %s: %+v", crdName, err)
+	}
+
+	err = manager.Detach(detachOpts.Image, detachOpts.Pool, detachOpts.ClusterName)
 	if err != nil {
 		return fmt.Errorf("Failed to detach volume %s/%s: %+v", detachOpts.Pool, detachOpts.Image, err)
 	}
 
-	namespace := os.Getenv(k8sutil.PodNamespaceEnvVar)
-	crdName := detachOpts.VolumeName
 	volumeAttach, err := c.volumeAttachmentController.Get(namespace, crdName)
 	if len(volumeAttach.Attachments) == 0 {
 		logger.Infof("Deleting VolumeAttachment CRD %s/%s", namespace, crdName)
@@ -209,6 +349,10 @@ func (c *FlexvolumeController) RemoveAttachmentObject(detachOpts AttachOptions,
 		return fmt.Errorf("failed to get Volume attach CRD %s/%s: %+v", namespace, crdName, err)
 	}
 	node := os.Getenv(k8sutil.NodeNameEnvVar)
+	if blocked, attachment := hasInFlightAttachOnNode(volumeAttach.Attachments, node); blocked {
+		return fmt.Errorf("volume %s still has an attach in progress for pod %s/%s on node %s. retry later",
+			crdName, attachment.PodNamespace, attachment.PodName, node)
+	}
 	nodeAttachmentCount := 0
 	needUpdate := false
 	for i, v := range volumeAttach.Attachments {
@@ -223,6 +367,7 @@ func (c *FlexvolumeController) RemoveAttachmentObject(detachOpts AttachOptions,
 	}
 
 	if needUpdate {
+		c.releaseSubPathLocks(detachOpts.MountDir)
 		// only one attachment on this node, which is the one that got removed.
 		if nodeAttachmentCount == 1 {
 			*safeToDetach = true
@@ -256,6 +401,18 @@ func (c *FlexvolumeController) parseClusterName(storageClassName string) (string
 	return clusterName, nil
 }
 
+// volumeManagerForStorageClass returns the VolumeManager that should handle attach/detach for
+// storageClassName: CephFS when the storage class opts in via its provisioner parameter, RBD
+// otherwise. It is resolved per call rather than once at startup because a single agent
+// serves every storage class on the node.
+func (c *FlexvolumeController) volumeManagerForStorageClass(storageClassName string) (VolumeManager, error) {
+	sc, err := c.clientset.Storage().StorageClasses().Get(storageClassName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get storage class %s: %+v", storageClassName, err)
+	}
+	return NewVolumeManager(sc.Parameters[provisionerKey]), nil
+}
+
 // GetAttachInfoFromMountDir obtain pod and volume information from the mountDir. K8s does not provide
 // all necessary information to detach a volume (https://github.com/kubernetes/kubernetes/issues/52590).
 // So we are hacking a bit and by parsing it from mountDir
@@ -306,6 +463,9 @@ func (c *FlexvolumeController) GetAttachInfoFromMountDir(mountDir string, attach
 	if attachOptions.StorageClass == "" {
 		attachOptions.StorageClass = pv.Spec.PersistentVolumeSource.FlexVolume.Options[StorageClassKey]
 	}
+	if attachOptions.AccessMode == "" && len(pv.Spec.AccessModes) > 0 {
+		attachOptions.AccessMode = AccessMode(pv.Spec.AccessModes[0])
+	}
 	attachOptions.ClusterName, err = c.parseClusterName(attachOptions.StorageClass)
 	if err != nil {
 		return fmt.Errorf("Failed to parse clusterName from storageClass %s: %+v", attachOptions.StorageClass, err)
@@ -368,6 +528,68 @@ func findPodByID(pods *v1.PodList, podUID types.UID) *v1.Pod {
 	return nil
 }
 
+// recordFailedAttachEvent records a FailedAttachVolume warning event on the requesting pod and
+// on the PV listing every pod currently holding the volume, so operators don't have to dig
+// through agent logs to find out who is blocking a new attach.
+func (c *FlexvolumeController) recordFailedAttachEvent(attachOpts AttachOptions, volumeattachObj crd.VolumeAttachment) {
+	reason := formatPodsUsingVolumeMessage(volumeattachObj.Attachments)
+
+	pod, err := c.clientset.Core().Pods(attachOpts.PodNamespace).Get(attachOpts.Pod, metav1.GetOptions{})
+	if err != nil {
+		logger.Warningf("failed to get pod %s/%s to record FailedAttachVolume event: %+v", attachOpts.PodNamespace, attachOpts.Pod, err)
+	} else {
+		c.eventRecorder.Eventf(pod, v1.EventTypeWarning, "FailedAttachVolume", reason)
+	}
+
+	pv, err := c.clientset.CoreV1().PersistentVolumes().Get(attachOpts.VolumeName, metav1.GetOptions{})
+	if err != nil {
+		logger.Warningf("failed to get PV %s to record FailedAttachVolume event: %+v", attachOpts.VolumeName, err)
+		return
+	}
+	c.eventRecorder.Eventf(pv, v1.EventTypeWarning, "FailedAttachVolume", reason)
+}
+
+// formatPodsUsingVolumeMessage builds a human readable message such as
+// "pods using volume: [ns/a (node node1, RW), ns/b (node node2, RO)]" enumerating every pod
+// (and its node and access mode) currently holding the volume.
+func formatPodsUsingVolumeMessage(attachments []crd.Attachment) string {
+	pods := make([]string, len(attachments))
+	for i, a := range attachments {
+		mode := "RW"
+		if a.ReadOnly {
+			mode = "RO"
+		}
+		pods[i] = fmt.Sprintf("%s/%s (node %s, %s)", a.PodNamespace, a.PodName, a.Node, mode)
+	}
+	return fmt.Sprintf("pods using volume: [%s]", strings.Join(pods, ", "))
+}
+
+// releaseSubPathLocks closes and forgets any subPath file handles held open for mountDir by
+// a prior MountDevice call, so a racing rename can once again touch that directory.
+func (c *FlexvolumeController) releaseSubPathLocks(mountDir string) {
+	c.subPathLocksMu.Lock()
+	defer c.subPathLocksMu.Unlock()
+	closeAll(c.subPathLocks[mountDir])
+	delete(c.subPathLocks, mountDir)
+}
+
+// hasInFlightAttachOnNode returns whether any non-stale attachment on node is still in the
+// Attaching state, along with that attachment. A stale Attaching record (older than
+// staleAttachingTimeout, e.g. left behind by a crashed attacher) does not count, so it can't
+// wedge the volume forever.
+func hasInFlightAttachOnNode(attachments []crd.Attachment, node string) (bool, crd.Attachment) {
+	for _, a := range attachments {
+		if a.Node != node || a.MountState != crd.Attaching {
+			continue
+		}
+		if time.Since(a.LastTransitionTime.Time) > staleAttachingTimeout {
+			continue
+		}
+		return true, a
+	}
+	return false, crd.Attachment{}
+}
+
 // getPodRWAttachmentObject loops through the list of attachments of the VolumeAttachment
 // resource and returns the index of the first RW attachment object
 func getPodRWAttachmentObject(volumeAttachmentObject crd.VolumeAttachment) int {
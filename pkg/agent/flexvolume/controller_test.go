@@ -0,0 +1,59 @@
+/*
+Copyright 2017 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package flexvolume
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rook/rook/pkg/agent/flexvolume/crd"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestHasInFlightAttachOnNode(t *testing.T) {
+	now := metav1.Now()
+
+	blocked, attachment := hasInFlightAttachOnNode([]crd.Attachment{
+		{Node: "node1", PodName: "pod1", MountState: crd.Attaching, LastTransitionTime: now},
+		{Node: "node2", PodName: "pod2", MountState: crd.Attaching, LastTransitionTime: now},
+	}, "node1")
+	assert.True(t, blocked)
+	assert.Equal(t, "pod1", attachment.PodName)
+}
+
+func TestHasInFlightAttachOnNodeIgnoresMounted(t *testing.T) {
+	blocked, _ := hasInFlightAttachOnNode([]crd.Attachment{
+		{Node: "node1", PodName: "pod1", MountState: crd.Mounted, LastTransitionTime: metav1.Now()},
+	}, "node1")
+	assert.False(t, blocked)
+}
+
+func TestHasInFlightAttachOnNodeIgnoresStaleAttaching(t *testing.T) {
+	stale := metav1.NewTime(time.Now().Add(-2 * staleAttachingTimeout))
+	blocked, _ := hasInFlightAttachOnNode([]crd.Attachment{
+		{Node: "node1", PodName: "pod1", MountState: crd.Attaching, LastTransitionTime: stale},
+	}, "node1")
+	assert.False(t, blocked)
+}
+
+func TestHasInFlightAttachOnNodeNoMatch(t *testing.T) {
+	blocked, _ := hasInFlightAttachOnNode([]crd.Attachment{
+		{Node: "node2", PodName: "pod2", MountState: crd.Attaching, LastTransitionTime: metav1.Now()},
+	}, "node1")
+	assert.False(t, blocked)
+}
@@ -0,0 +1,118 @@
+/*
+Copyright 2017 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package crd manages the VolumeAttachment custom resource (and its TPR predecessor) that
+// records which pods currently hold a Rook volume attached.
+package crd
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// MountState describes where an Attachment is in its attach/mount lifecycle. It is used to
+// fence Detach/RemoveAttachmentObject away from an attachment whose mount step is still
+// in flight on the same node.
+type MountState string
+
+const (
+	// Attaching is set before the flex driver's attach step is called and before the mount
+	// step has confirmed the device is in use.
+	Attaching MountState = "Attaching"
+	// Mounted is set once the flex driver reports the volume is mounted on the node.
+	Mounted MountState = "Mounted"
+)
+
+// VolumeAttachment holds the set of pods that currently have a Rook volume attached. The
+// resource is named after the PV so it can double as a fencing record.
+type VolumeAttachment struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	// Image, Pool and ClusterName identify the underlying rbd/image backing this volume, so
+	// it can be detached without needing to consult the PV (e.g. from the reconciler, which
+	// runs independently of any particular Attach/Detach call).
+	Image       string `json:"image"`
+	Pool        string `json:"pool"`
+	ClusterName string `json:"clusterName"`
+	// AccessMode is the access mode negotiated by the first attacher. Subsequent attachers
+	// must request a compatible mode: a ReadWriteOnce volume cannot also be attached
+	// ReadWriteMany, and vice versa.
+	AccessMode  string       `json:"accessMode"`
+	Attachments []Attachment `json:"attachments"`
+}
+
+// Attachment records a single pod's attachment to a volume.
+type Attachment struct {
+	Node         string     `json:"node"`
+	PodNamespace string     `json:"podNamespace"`
+	PodName      string     `json:"podName"`
+	MountDir     string     `json:"mountDir"`
+	ReadOnly     bool       `json:"readOnly"`
+	MountState   MountState `json:"mountState"`
+	// LastTransitionTime records when MountState last changed, so a crashed attacher that
+	// never reaches Mounted can be detected and the attachment reclaimed.
+	LastTransitionTime metav1.Time `json:"lastTransitionTime,omitempty"`
+}
+
+// TransitionTo moves the Attachment to the given MountState and records the transition time.
+func (a *Attachment) TransitionTo(state MountState, now metav1.Time) {
+	a.MountState = state
+	a.LastTransitionTime = now
+}
+
+// VolumeAttachmentController is implemented by both the CRD-backed and the legacy TPR-backed
+// stores so FlexvolumeController does not need to know which one is in use.
+type VolumeAttachmentController interface {
+	Get(namespace, name string) (VolumeAttachment, error)
+	List(namespace string) (*VolumeAttachmentList, error)
+	Create(VolumeAttachment) error
+	Update(VolumeAttachment) error
+	Delete(namespace, name string) error
+}
+
+// VolumeAttachmentList is a list of VolumeAttachment resources.
+type VolumeAttachmentList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []VolumeAttachment `json:"items"`
+}
+
+// NewVolumeAttachment creates a VolumeAttachment resource with a single attachment entry.
+func NewVolumeAttachment(name, namespace, node, podNamespace, pod, mountDir string, readOnly bool,
+	image, pool, clusterName, accessMode string) VolumeAttachment {
+	return VolumeAttachment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+		},
+		Image:       image,
+		Pool:        pool,
+		ClusterName: clusterName,
+		AccessMode:  accessMode,
+		Attachments: []Attachment{
+			{
+				Node:               node,
+				PodNamespace:       podNamespace,
+				PodName:            pod,
+				MountDir:           mountDir,
+				ReadOnly:           readOnly,
+				MountState:         Attaching,
+				LastTransitionTime: metav1.Now(),
+			},
+		},
+	}
+}
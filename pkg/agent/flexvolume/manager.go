@@ -0,0 +1,125 @@
+/*
+Copyright 2017 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package flexvolume
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+const (
+	// provisionerKey is the storage class parameter that selects the VolumeManager.
+	provisionerKey = "provisioner"
+	// cephFSProvisioner is the storage class parameter value that selects the CephFS-backed
+	// VolumeManager; any other (or missing) provisioner defaults to RBD, matching Rook's
+	// long-standing behavior.
+	cephFSProvisioner = "cephfs"
+)
+
+// RBDManager attaches/detaches a volume backed by an RBD image by shelling out to `rbd
+// map`/`rbd unmap`. It only supports ReadWriteOnce/ReadOnlyMany, enforced by the caller in
+// FlexvolumeController.Attach.
+type RBDManager struct{}
+
+// NewRBDManager creates a VolumeManager that attaches RBD images.
+func NewRBDManager() *RBDManager {
+	return &RBDManager{}
+}
+
+// Attach maps the RBD image and returns the resulting device path.
+func (m *RBDManager) Attach(image, pool, clusterName string) (string, error) {
+	out, err := exec.Command("rbd", "map", image, "--pool", pool, "--cluster", clusterName).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("failed to map image %s/%s: %+v. output: %s", pool, image, err, string(out))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// Detach unmaps the RBD image.
+func (m *RBDManager) Detach(image, pool, clusterName string) error {
+	if out, err := exec.Command("rbd", "unmap", fmt.Sprintf("%s/%s", pool, image), "--cluster", clusterName).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to unmap image %s/%s: %+v. output: %s", pool, image, err, string(out))
+	}
+	return nil
+}
+
+// CephFSManager attaches/detaches a subvolume of a CephFS filesystem by mounting/unmounting it
+// with the kernel ceph client. Unlike RBDManager, it is genuinely ReadWriteMany capable: many
+// nodes can mount the same CephFS volume at once.
+type CephFSManager struct{}
+
+// NewCephFSManager creates a VolumeManager that mounts CephFS subvolumes.
+func NewCephFSManager() *CephFSManager {
+	return &CephFSManager{}
+}
+
+// Attach mounts the CephFS subvolume identified by image (the subvolume path) within the
+// filesystem pool and returns the mount source understood by the kernel ceph client.
+func (m *CephFSManager) Attach(image, pool, clusterName string) (string, error) {
+	source := fmt.Sprintf("%s:%s", clusterName, image)
+	if out, err := exec.Command("mount", "-t", "ceph", source, "-o", fmt.Sprintf("mds_namespace=%s", pool)).CombinedOutput(); err != nil {
+		return "", fmt.Errorf("failed to mount cephfs %s on filesystem %s: %+v. output: %s", image, pool, err, string(out))
+	}
+	return source, nil
+}
+
+// Detach unmounts the CephFS subvolume.
+func (m *CephFSManager) Detach(image, pool, clusterName string) error {
+	source := fmt.Sprintf("%s:%s", clusterName, image)
+	if out, err := exec.Command("umount", source).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to unmount cephfs %s: %+v. output: %s", image, err, string(out))
+	}
+	return nil
+}
+
+// NewVolumeManager selects the VolumeManager implementation for a storage class: CephFS when
+// the storage class opts in via its provisioner parameter, RBD otherwise.
+func NewVolumeManager(provisioner string) VolumeManager {
+	if provisioner == cephFSProvisioner {
+		return NewCephFSManager()
+	}
+	return NewRBDManager()
+}
+
+// accessModeFor derives the AccessMode the controller should enforce for a volume manager, for
+// use when the caller didn't already have one from the PV's own spec.AccessModes. Only CephFS
+// is genuinely RWX-capable.
+func accessModeFor(manager VolumeManager, requestedRW string) (AccessMode, error) {
+	if _, isCephFS := manager.(*CephFSManager); isCephFS {
+		return ReadWriteMany, nil
+	}
+	switch strings.ToLower(requestedRW) {
+	case ReadOnly:
+		return ReadOnlyMany, nil
+	case "rw":
+		return ReadWriteOnce, nil
+	default:
+		return "", fmt.Errorf("unknown RW mode %q", requestedRW)
+	}
+}
+
+// validateAccessModeForManager checks that accessMode, as declared on the PV, is one the
+// selected VolumeManager can actually honor. Only ReadWriteMany is restricted: RBD can't do
+// RWX, full stop. CephFS is not limited to RWX - a CephFS-backed PV provisioned RWO or ROM is
+// a perfectly normal configuration and must keep working.
+func validateAccessModeForManager(manager VolumeManager, accessMode AccessMode) error {
+	if _, isCephFS := manager.(*CephFSManager); accessMode == ReadWriteMany && !isCephFS {
+		return fmt.Errorf("access mode %s requires a CephFS-backed storage class", ReadWriteMany)
+	}
+	return nil
+}
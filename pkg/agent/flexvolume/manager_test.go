@@ -0,0 +1,39 @@
+/*
+Copyright 2017 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package flexvolume
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewVolumeManagerSelectsByProvisioner(t *testing.T) {
+	assert.IsType(t, &CephFSManager{}, NewVolumeManager("cephfs"))
+	assert.IsType(t, &RBDManager{}, NewVolumeManager("rbd"))
+	assert.IsType(t, &RBDManager{}, NewVolumeManager(""))
+}
+
+func TestValidateAccessModeForManager(t *testing.T) {
+	assert.NoError(t, validateAccessModeForManager(NewCephFSManager(), ReadWriteMany))
+	assert.Error(t, validateAccessModeForManager(NewRBDManager(), ReadWriteMany))
+	assert.NoError(t, validateAccessModeForManager(NewRBDManager(), ReadWriteOnce))
+	// A CephFS-backed PV provisioned RWO or ROM (a common, legitimate configuration) must not
+	// be rejected: only RBD claiming RWX is actually invalid.
+	assert.NoError(t, validateAccessModeForManager(NewCephFSManager(), ReadWriteOnce))
+	assert.NoError(t, validateAccessModeForManager(NewCephFSManager(), ReadOnlyMany))
+}
@@ -0,0 +1,89 @@
+/*
+Copyright 2017 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reconciler
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	initialBackoff = 5 * time.Second
+	maxBackoff     = 5 * time.Minute
+)
+
+// volumeBackoff tracks per-volume exponential backoff so a persistently failing detach
+// doesn't hot-loop the reconciler, while a volume that starts succeeding again recovers
+// immediately.
+type volumeBackoff struct {
+	mu    sync.Mutex
+	state map[string]*backoffEntry
+}
+
+type backoffEntry struct {
+	next    time.Duration
+	retryAt time.Time
+}
+
+func newVolumeBackoff() *volumeBackoff {
+	return &volumeBackoff{state: map[string]*backoffEntry{}}
+}
+
+// ShouldSkip returns true if volumeName is still within its backoff window.
+func (b *volumeBackoff) ShouldSkip(volumeName string, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	entry, ok := b.state[volumeName]
+	return ok && now.Before(entry.retryAt)
+}
+
+// Failure records a failed attempt for volumeName and doubles its backoff, capped at maxBackoff.
+func (b *volumeBackoff) Failure(volumeName string, now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	entry, ok := b.state[volumeName]
+	if !ok {
+		entry = &backoffEntry{next: initialBackoff}
+		b.state[volumeName] = entry
+	} else {
+		entry.next *= 2
+		if entry.next > maxBackoff {
+			entry.next = maxBackoff
+		}
+	}
+	entry.retryAt = now.Add(entry.next)
+	return entry.next
+}
+
+// Success clears any backoff recorded for volumeName.
+func (b *volumeBackoff) Success(volumeName string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.state, volumeName)
+}
+
+// Snapshot returns the current backoff duration for every volume being tracked, for the
+// metrics endpoint.
+func (b *volumeBackoff) Snapshot() map[string]time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	snapshot := make(map[string]time.Duration, len(b.state))
+	for volumeName, entry := range b.state {
+		snapshot[volumeName] = entry.next
+	}
+	return snapshot
+}
@@ -0,0 +1,60 @@
+/*
+Copyright 2017 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reconciler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVolumeBackoffDoublesAndCaps(t *testing.T) {
+	b := newVolumeBackoff()
+	now := time.Now()
+
+	assert.Equal(t, initialBackoff, b.Failure("vol1", now))
+	assert.Equal(t, 2*initialBackoff, b.Failure("vol1", now))
+	assert.Equal(t, 4*initialBackoff, b.Failure("vol1", now))
+
+	for i := 0; i < 10; i++ {
+		b.Failure("vol1", now)
+	}
+	assert.Equal(t, maxBackoff, b.Failure("vol1", now))
+}
+
+func TestVolumeBackoffShouldSkip(t *testing.T) {
+	b := newVolumeBackoff()
+	now := time.Now()
+
+	assert.False(t, b.ShouldSkip("vol1", now))
+	b.Failure("vol1", now)
+	assert.True(t, b.ShouldSkip("vol1", now))
+	assert.False(t, b.ShouldSkip("vol1", now.Add(initialBackoff+time.Second)))
+}
+
+func TestVolumeBackoffSuccessClearsState(t *testing.T) {
+	b := newVolumeBackoff()
+	now := time.Now()
+
+	b.Failure("vol1", now)
+	assert.True(t, b.ShouldSkip("vol1", now))
+
+	b.Success("vol1")
+	assert.False(t, b.ShouldSkip("vol1", now))
+	assert.Empty(t, b.Snapshot())
+}
@@ -0,0 +1,46 @@
+/*
+Copyright 2017 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reconciler
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var volumeBackoffSeconds = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "rook",
+		Subsystem: "flexvolume_reconciler",
+		Name:      "volume_backoff_seconds",
+		Help:      "Current detach retry backoff, in seconds, for orphaned VolumeAttachment CRDs that failed to reconcile",
+	},
+	[]string{"volume"},
+)
+
+func init() {
+	prometheus.MustRegister(volumeBackoffSeconds)
+}
+
+// reportBackoff publishes the reconciler's current per-volume backoff state so operators can
+// see which volumes are stuck cleaning up without reading agent logs.
+func reportBackoff(snapshot map[string]time.Duration) {
+	volumeBackoffSeconds.Reset()
+	for volumeName, d := range snapshot {
+		volumeBackoffSeconds.WithLabelValues(volumeName).Set(d.Seconds())
+	}
+}
@@ -0,0 +1,184 @@
+/*
+Copyright 2017 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package reconciler periodically garbage-collects VolumeAttachment CRDs that were orphaned
+// because a node died mid-attach or kubelet never called back into the flex driver to detach.
+package reconciler
+
+import (
+	"os"
+	"time"
+
+	"github.com/coreos/pkg/capnslog"
+	"github.com/rook/rook/pkg/agent/flexvolume/crd"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	defaultReconcileInterval = 60 * time.Second
+
+	// staleAttachingTimeout mirrors flexvolume.staleAttachingTimeout: how long an attachment
+	// can stay in the Attaching state before the reconciler stops giving it the benefit of
+	// the doubt and is willing to consider it orphaned like any other attachment.
+	staleAttachingTimeout = 10 * time.Minute
+)
+
+var logger = capnslog.NewPackageLogger("github.com/rook/rook", "rook-flexvolume-reconciler")
+
+// VolumeDetacher detaches the underlying image for a volume once its VolumeAttachment CRD has
+// been emptied of live attachments. It is satisfied by flexvolume.VolumeManager.
+type VolumeDetacher interface {
+	Detach(image, pool, clusterName string) error
+}
+
+// Reconciler garbage-collects VolumeAttachment CRDs owned by this node whose recorded pod is
+// gone or whose mountDir no longer exists on disk.
+type Reconciler struct {
+	clientset                  kubernetes.Interface
+	volumeAttachmentController crd.VolumeAttachmentController
+	volumeManager              VolumeDetacher
+	nodeName                   string
+	kubeletRootDir             string
+	interval                   time.Duration
+	backoff                    *volumeBackoff
+}
+
+// New creates a Reconciler that reconciles VolumeAttachment CRDs for nodeName every interval.
+// A zero interval defaults to 60 seconds.
+func New(clientset kubernetes.Interface, volumeAttachmentController crd.VolumeAttachmentController,
+	volumeManager VolumeDetacher, nodeName, kubeletRootDir string, interval time.Duration) *Reconciler {
+
+	if interval <= 0 {
+		interval = defaultReconcileInterval
+	}
+	return &Reconciler{
+		clientset:                  clientset,
+		volumeAttachmentController: volumeAttachmentController,
+		volumeManager:              volumeManager,
+		nodeName:                   nodeName,
+		kubeletRootDir:             kubeletRootDir,
+		interval:                   interval,
+		backoff:                    newVolumeBackoff(),
+	}
+}
+
+// Run reconciles on a timer until stopCh is closed.
+func (r *Reconciler) Run(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			r.reconcile()
+		}
+	}
+}
+
+// reconcile lists every VolumeAttachment CRD owned by this node and cleans up any attachment
+// whose pod is gone or whose mountDir no longer exists under the kubelet root.
+func (r *Reconciler) reconcile() {
+	list, err := r.volumeAttachmentController.List(metav1.NamespaceAll)
+	if err != nil {
+		logger.Errorf("failed to list VolumeAttachment CRDs: %+v", err)
+		return
+	}
+
+	now := time.Now()
+	for _, volumeAttach := range list.Items {
+		if r.backoff.ShouldSkip(volumeAttach.Name, now) {
+			continue
+		}
+		if err := r.reconcileVolume(volumeAttach); err != nil {
+			backoff := r.backoff.Failure(volumeAttach.Name, now)
+			logger.Warningf("failed to reconcile VolumeAttachment %s/%s, retrying in %s: %+v",
+				volumeAttach.Namespace, volumeAttach.Name, backoff, err)
+		} else {
+			r.backoff.Success(volumeAttach.Name)
+		}
+	}
+	reportBackoff(r.backoff.Snapshot())
+}
+
+func (r *Reconciler) reconcileVolume(volumeAttach crd.VolumeAttachment) error {
+	live := make([]crd.Attachment, 0, len(volumeAttach.Attachments))
+	selfPruned := false
+	for _, a := range volumeAttach.Attachments {
+		if a.Node != r.nodeName {
+			live = append(live, a)
+			continue
+		}
+		orphaned, err := r.isOrphaned(a)
+		if err != nil {
+			return err
+		}
+		if orphaned {
+			selfPruned = true
+		} else {
+			live = append(live, a)
+		}
+	}
+
+	if len(live) == len(volumeAttach.Attachments) {
+		// Nothing changed.
+		return nil
+	}
+
+	// This node's own attachment was pruned, so its local rbd map/ceph mount must be torn
+	// down here: the CRD record being dropped is the only thing that would otherwise let a
+	// later reconcile pass find it again, regardless of whether other nodes still hold the
+	// volume (they may, once it's RWX-capable).
+	if selfPruned {
+		if err := r.volumeManager.Detach(volumeAttach.Image, volumeAttach.Pool, volumeAttach.ClusterName); err != nil {
+			return err
+		}
+	}
+
+	volumeAttach.Attachments = live
+	if len(live) == 0 {
+		return r.volumeAttachmentController.Delete(volumeAttach.Namespace, volumeAttach.Name)
+	}
+	return r.volumeAttachmentController.Update(volumeAttach)
+}
+
+// isOrphaned returns true if the pod that owns attachment a is gone or its mountDir no longer
+// exists on disk, meaning kubelet never called back to detach it. An attachment that is still
+// Attaching and within staleAttachingTimeout is never considered orphaned: MountDir legitimately
+// doesn't exist yet between Attach creating the CRD record and kubelet finishing the mount, and
+// pruning it here would race the in-flight Attach/MountDevice call on the very same attachment.
+func (r *Reconciler) isOrphaned(a crd.Attachment) (bool, error) {
+	if a.MountState == crd.Attaching && time.Since(a.LastTransitionTime.Time) <= staleAttachingTimeout {
+		return false, nil
+	}
+
+	_, err := r.clientset.Core().Pods(a.PodNamespace).Get(a.PodName, metav1.GetOptions{})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return true, nil
+		}
+		return false, err
+	}
+
+	if a.MountDir != "" {
+		if _, err := os.Stat(a.MountDir); os.IsNotExist(err) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
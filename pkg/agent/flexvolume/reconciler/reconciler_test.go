@@ -0,0 +1,223 @@
+/*
+Copyright 2017 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reconciler
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/rook/rook/pkg/agent/flexvolume/crd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// fakeVolumeAttachmentController is an in-memory crd.VolumeAttachmentController for tests.
+type fakeVolumeAttachmentController struct {
+	attachments map[string]crd.VolumeAttachment
+	updated     []crd.VolumeAttachment
+	deletedKeys []string
+}
+
+func newFakeVolumeAttachmentController(attachments ...crd.VolumeAttachment) *fakeVolumeAttachmentController {
+	f := &fakeVolumeAttachmentController{attachments: map[string]crd.VolumeAttachment{}}
+	for _, a := range attachments {
+		f.attachments[a.Namespace+"/"+a.Name] = a
+	}
+	return f
+}
+
+func (f *fakeVolumeAttachmentController) Get(namespace, name string) (crd.VolumeAttachment, error) {
+	a, ok := f.attachments[namespace+"/"+name]
+	if !ok {
+		return crd.VolumeAttachment{}, errors.NewNotFound(schema.GroupResource{Resource: "volumeattachments"}, name)
+	}
+	return a, nil
+}
+
+func (f *fakeVolumeAttachmentController) List(namespace string) (*crd.VolumeAttachmentList, error) {
+	list := &crd.VolumeAttachmentList{}
+	for _, a := range f.attachments {
+		list.Items = append(list.Items, a)
+	}
+	return list, nil
+}
+
+func (f *fakeVolumeAttachmentController) Create(a crd.VolumeAttachment) error {
+	f.attachments[a.Namespace+"/"+a.Name] = a
+	return nil
+}
+
+func (f *fakeVolumeAttachmentController) Update(a crd.VolumeAttachment) error {
+	f.attachments[a.Namespace+"/"+a.Name] = a
+	f.updated = append(f.updated, a)
+	return nil
+}
+
+func (f *fakeVolumeAttachmentController) Delete(namespace, name string) error {
+	delete(f.attachments, namespace+"/"+name)
+	f.deletedKeys = append(f.deletedKeys, namespace+"/"+name)
+	return nil
+}
+
+// fakeVolumeDetacher counts Detach calls so tests can assert whether the reconciler tore down
+// the local attachment or not.
+type fakeVolumeDetacher struct {
+	calls int
+}
+
+func (f *fakeVolumeDetacher) Detach(image, pool, clusterName string) error {
+	f.calls++
+	return nil
+}
+
+func newTestReconciler(controller crd.VolumeAttachmentController, detacher VolumeDetacher, nodeName string) *Reconciler {
+	return New(fake.NewSimpleClientset(), controller, detacher, nodeName, "", time.Second)
+}
+
+func TestIsOrphanedPodGone(t *testing.T) {
+	r := New(fake.NewSimpleClientset(), nil, nil, "node1", "", time.Second)
+	orphaned, err := r.isOrphaned(crd.Attachment{
+		PodNamespace: "ns", PodName: "missing", MountState: crd.Mounted,
+	})
+	require.NoError(t, err)
+	assert.True(t, orphaned)
+}
+
+func TestIsOrphanedMountDirGone(t *testing.T) {
+	clientset := fake.NewSimpleClientset(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod1", Namespace: "ns"}})
+	r := New(clientset, nil, nil, "node1", "", time.Second)
+	orphaned, err := r.isOrphaned(crd.Attachment{
+		PodNamespace: "ns", PodName: "pod1", MountDir: "/does/not/exist", MountState: crd.Mounted,
+	})
+	require.NoError(t, err)
+	assert.True(t, orphaned)
+}
+
+func TestIsOrphanedNotOrphaned(t *testing.T) {
+	mountDir, err := ioutil.TempDir("", "reconciler-mountdir")
+	require.NoError(t, err)
+	defer os.RemoveAll(mountDir)
+
+	clientset := fake.NewSimpleClientset(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod1", Namespace: "ns"}})
+	r := New(clientset, nil, nil, "node1", "", time.Second)
+	orphaned, err := r.isOrphaned(crd.Attachment{
+		PodNamespace: "ns", PodName: "pod1", MountDir: mountDir, MountState: crd.Mounted,
+	})
+	require.NoError(t, err)
+	assert.False(t, orphaned)
+}
+
+// TestIsOrphanedSkipsInFlightAttach reproduces the race this fix closes: MountDir legitimately
+// doesn't exist yet while an Attach is still in flight, and that must not look orphaned.
+func TestIsOrphanedSkipsInFlightAttach(t *testing.T) {
+	clientset := fake.NewSimpleClientset(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod1", Namespace: "ns"}})
+	r := New(clientset, nil, nil, "node1", "", time.Second)
+	orphaned, err := r.isOrphaned(crd.Attachment{
+		PodNamespace:       "ns",
+		PodName:            "pod1",
+		MountDir:           "/does/not/exist/yet",
+		MountState:         crd.Attaching,
+		LastTransitionTime: metav1.Now(),
+	})
+	require.NoError(t, err)
+	assert.False(t, orphaned)
+}
+
+func TestIsOrphanedDoesNotSkipStaleAttaching(t *testing.T) {
+	clientset := fake.NewSimpleClientset(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod1", Namespace: "ns"}})
+	r := New(clientset, nil, nil, "node1", "", time.Second)
+	orphaned, err := r.isOrphaned(crd.Attachment{
+		PodNamespace:       "ns",
+		PodName:            "pod1",
+		MountDir:           "/does/not/exist/yet",
+		MountState:         crd.Attaching,
+		LastTransitionTime: metav1.NewTime(time.Now().Add(-2 * staleAttachingTimeout)),
+	})
+	require.NoError(t, err)
+	assert.True(t, orphaned)
+}
+
+func TestReconcileVolumeDetachesAndDeletesWhenLastAttachmentPruned(t *testing.T) {
+	volumeAttach := crd.VolumeAttachment{
+		ObjectMeta: metav1.ObjectMeta{Name: "pv1", Namespace: "ns"},
+		Image:      "image1", Pool: "pool1", ClusterName: "rook",
+		Attachments: []crd.Attachment{
+			{Node: "node1", PodNamespace: "ns", PodName: "gone", MountState: crd.Mounted},
+		},
+	}
+	controller := newFakeVolumeAttachmentController(volumeAttach)
+	detacher := &fakeVolumeDetacher{}
+	r := newTestReconciler(controller, detacher, "node1")
+
+	require.NoError(t, r.reconcileVolume(volumeAttach))
+
+	assert.Equal(t, 1, detacher.calls)
+	assert.Contains(t, controller.deletedKeys, "ns/pv1")
+}
+
+func TestReconcileVolumeDetachesSelfEvenWhenOtherNodesStillLive(t *testing.T) {
+	volumeAttach := crd.VolumeAttachment{
+		ObjectMeta: metav1.ObjectMeta{Name: "pv1", Namespace: "ns"},
+		Image:      "image1", Pool: "pool1", ClusterName: "rook",
+		Attachments: []crd.Attachment{
+			{Node: "node1", PodNamespace: "ns", PodName: "gone", MountState: crd.Mounted},
+			{Node: "node2", PodNamespace: "ns", PodName: "still-here", MountState: crd.Mounted},
+		},
+	}
+	clientset := fake.NewSimpleClientset(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "still-here", Namespace: "ns"}})
+	controller := newFakeVolumeAttachmentController(volumeAttach)
+	detacher := &fakeVolumeDetacher{}
+	r := New(clientset, controller, detacher, "node1", "", time.Second)
+
+	require.NoError(t, r.reconcileVolume(volumeAttach))
+
+	assert.Equal(t, 1, detacher.calls, "this node's local attachment must still be detached")
+	assert.Empty(t, controller.deletedKeys, "other node's attachment is still live, CRD must not be deleted")
+	require.Len(t, controller.updated, 1)
+	assert.Len(t, controller.updated[0].Attachments, 1)
+	assert.Equal(t, "node2", controller.updated[0].Attachments[0].Node)
+}
+
+func TestReconcileVolumeLeavesInFlightAttachAlone(t *testing.T) {
+	volumeAttach := crd.VolumeAttachment{
+		ObjectMeta: metav1.ObjectMeta{Name: "pv1", Namespace: "ns"},
+		Image:      "image1", Pool: "pool1", ClusterName: "rook",
+		Attachments: []crd.Attachment{
+			{
+				Node: "node1", PodNamespace: "ns", PodName: "pod1", MountDir: "/does/not/exist/yet",
+				MountState: crd.Attaching, LastTransitionTime: metav1.Now(),
+			},
+		},
+	}
+	clientset := fake.NewSimpleClientset(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod1", Namespace: "ns"}})
+	controller := newFakeVolumeAttachmentController(volumeAttach)
+	detacher := &fakeVolumeDetacher{}
+	r := New(clientset, controller, detacher, "node1", "", time.Second)
+
+	require.NoError(t, r.reconcileVolume(volumeAttach))
+
+	assert.Zero(t, detacher.calls)
+	assert.Empty(t, controller.updated)
+	assert.Empty(t, controller.deletedKeys)
+}
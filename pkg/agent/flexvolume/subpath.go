@@ -0,0 +1,101 @@
+/*
+Copyright 2017 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package flexvolume
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// resolveAndLockSubPath walks subPath component-by-component starting at volumeRoot, refusing
+// any component that is a symlink or that would resolve outside volumeRoot (e.g. "..").
+//
+// Each component is opened with openat(2), O_NOFOLLOW, relative to the file descriptor of the
+// directory opened for the previous component, rather than lstat-then-open on a path string.
+// That makes the walk immune to a rename/symlink-swap race: once a parent directory's fd is
+// held, nothing done to its name afterwards changes what that fd refers to, and O_NOFOLLOW
+// makes the open fail atomically if the entry turns out to be a symlink instead of silently
+// following it. A walk built from lstat+open on path strings, plus a final re-resolve of the
+// whole path, has a window between every one of those steps for the filesystem underneath it
+// to change; chaining fds closes that window because there's nothing left to re-resolve.
+// Because every step is rooted at volumeRoot's own fd and no component may be "..", the walk
+// can never reach outside volumeRoot in the first place, so there is no separate containment
+// check to get wrong.
+//
+// It returns a bind-mount source along with an open file handle on volumeRoot and on every
+// subPath component it walked through, the final one included; the caller must keep those handles open for as long as the
+// mount built from the returned source is live, and Close them afterwards. The returned source
+// is a /proc/<pid>/fd/<n> reference to the held descriptor on the final component, so mounting
+// from it is guaranteed to operate on the exact file this function validated.
+func resolveAndLockSubPath(volumeRoot, subPath string) (string, []io.Closer, error) {
+	if subPath == "" {
+		return volumeRoot, nil, nil
+	}
+
+	cleanRoot := filepath.Clean(volumeRoot)
+	root, err := os.Open(cleanRoot)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to open volume root %s: %+v", volumeRoot, err)
+	}
+	handles := []io.Closer{root}
+	parent := root
+	current := cleanRoot
+
+	for _, component := range strings.Split(filepath.Clean(subPath), string(filepath.Separator)) {
+		if component == "" || component == "." {
+			continue
+		}
+		if component == ".." {
+			closeAll(handles)
+			return "", nil, fmt.Errorf("subPath %q is not allowed to contain '..'", subPath)
+		}
+
+		next := filepath.Join(current, component)
+
+		fd, err := syscall.Openat(int(parent.Fd()), component, syscall.O_NOFOLLOW|syscall.O_RDONLY|syscall.O_CLOEXEC, 0)
+		if err != nil {
+			closeAll(handles)
+			if err == syscall.ELOOP {
+				return "", nil, fmt.Errorf("subPath component %s is a symlink, refusing to mount", next)
+			}
+			return "", nil, fmt.Errorf("failed to open subPath component %s: %+v", next, err)
+		}
+
+		f := os.NewFile(uintptr(fd), next)
+		handles = append(handles, f)
+		parent = f
+		current = next
+	}
+
+	if parent == root {
+		// subPath cleaned down to "." (e.g. "." or "./"); nothing to descend into.
+		closeAll(handles)
+		return volumeRoot, nil, nil
+	}
+
+	return fmt.Sprintf("/proc/%d/fd/%d", os.Getpid(), parent.Fd()), handles, nil
+}
+
+func closeAll(handles []io.Closer) {
+	for _, h := range handles {
+		h.Close()
+	}
+}
@@ -0,0 +1,133 @@
+/*
+Copyright 2017 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package flexvolume
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveAndLockSubPathNoSubPath(t *testing.T) {
+	root, err := ioutil.TempDir("", "subpath-root")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	resolved, handles, err := resolveAndLockSubPath(root, "")
+	require.NoError(t, err)
+	assert.Equal(t, root, resolved)
+	assert.Empty(t, handles)
+}
+
+func TestResolveAndLockSubPathValid(t *testing.T) {
+	root, err := ioutil.TempDir("", "subpath-root")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "a", "b"), 0755))
+
+	resolved, handles, err := resolveAndLockSubPath(root, "a/b")
+	require.NoError(t, err)
+	defer closeAll(handles)
+	assert.Equal(t, fmt.Sprintf("/proc/%d/fd/%d", os.Getpid(), handles[len(handles)-1].(*os.File).Fd()), resolved)
+	// One handle for volumeRoot itself, plus one per subPath component ("a", "b").
+	assert.Len(t, handles, 3)
+}
+
+func TestResolveAndLockSubPathRejectsDotDot(t *testing.T) {
+	root, err := ioutil.TempDir("", "subpath-root")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	_, handles, err := resolveAndLockSubPath(root, "../escape")
+	assert.Error(t, err)
+	assert.Empty(t, handles)
+}
+
+func TestResolveAndLockSubPathRejectsSymlink(t *testing.T) {
+	root, err := ioutil.TempDir("", "subpath-root")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	outside, err := ioutil.TempDir("", "subpath-outside")
+	require.NoError(t, err)
+	defer os.RemoveAll(outside)
+
+	require.NoError(t, os.Symlink(outside, filepath.Join(root, "link")))
+
+	_, handles, err := resolveAndLockSubPath(root, "link")
+	assert.Error(t, err)
+	assert.Empty(t, handles)
+}
+
+func TestResolveAndLockSubPathRejectsSymlinkInMiddle(t *testing.T) {
+	root, err := ioutil.TempDir("", "subpath-root")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	outside, err := ioutil.TempDir("", "subpath-outside")
+	require.NoError(t, err)
+	defer os.RemoveAll(outside)
+	require.NoError(t, os.MkdirAll(filepath.Join(outside, "secret"), 0755))
+
+	require.NoError(t, os.Symlink(outside, filepath.Join(root, "link")))
+
+	// The symlink is not the final subPath component; O_NOFOLLOW must still catch it partway
+	// through the walk rather than only at the end.
+	_, handles, err := resolveAndLockSubPath(root, "link/secret")
+	assert.Error(t, err)
+	assert.Empty(t, handles)
+}
+
+func TestResolveAndLockSubPathReturnsUsableFd(t *testing.T) {
+	root, err := ioutil.TempDir("", "subpath-root")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "a"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(root, "a", "file"), []byte("hello"), 0644))
+
+	resolved, handles, err := resolveAndLockSubPath(root, "a/file")
+	require.NoError(t, err)
+	defer closeAll(handles)
+
+	content, err := ioutil.ReadFile(resolved)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(content))
+}
+
+func TestResolveAndLockSubPathAllowsSymlinkedAncestorOfRoot(t *testing.T) {
+	parent, err := ioutil.TempDir("", "subpath-parent")
+	require.NoError(t, err)
+	defer os.RemoveAll(parent)
+
+	real := filepath.Join(parent, "real")
+	require.NoError(t, os.MkdirAll(filepath.Join(real, "vol1", "a"), 0755))
+	link := filepath.Join(parent, "link")
+	require.NoError(t, os.Symlink(real, link))
+
+	// kubelet's plugin directory can itself sit behind a symlinked ancestor; that alone
+	// must not make a legitimate subPath under it look like it escapes the volume root.
+	root := filepath.Join(link, "vol1")
+	resolved, handles, err := resolveAndLockSubPath(root, "a")
+	require.NoError(t, err)
+	defer closeAll(handles)
+	assert.NotEmpty(t, resolved)
+}
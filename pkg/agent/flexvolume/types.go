@@ -0,0 +1,88 @@
+/*
+Copyright 2017 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package flexvolume
+
+import (
+	"github.com/coreos/pkg/capnslog"
+)
+
+const (
+	// FlexvolumeVendor is the vendor directory segment of the flexvolume driver's plugin path.
+	FlexvolumeVendor = "rook.io"
+	// FlexvolumeDriver is the driver directory segment of the flexvolume driver's plugin path.
+	FlexvolumeDriver = "rook"
+
+	// ReadOnly is the value of AttachOptions.RW for a read-only attach request.
+	ReadOnly = "ro"
+
+	serverVersionV170 = "v1.7.0"
+)
+
+var logger = capnslog.NewPackageLogger("github.com/rook/rook", "rook-flexvolume")
+
+// AccessMode mirrors the subset of a PV's spec.accessModes that determine how strictly the
+// controller has to enforce exclusivity between attachments of the same volume.
+type AccessMode string
+
+const (
+	// ReadWriteOnce allows a single RW attachment, with any number of RO attachments alongside
+	// it disallowed; this is the long-standing default for RBD-backed volumes.
+	ReadWriteOnce AccessMode = "ReadWriteOnce"
+	// ReadOnlyMany is the mode inferred for RO attach requests. Attach applies the same
+	// RW-exclusivity check to it as to ReadWriteOnce; an RW request on a PV that declares
+	// ReadOnlyMany is not rejected on account of the mode.
+	ReadOnlyMany AccessMode = "ReadOnlyMany"
+	// ReadWriteMany allows any number of RW attachments at once; only genuinely RWX-capable
+	// backends such as CephFS may use this.
+	ReadWriteMany AccessMode = "ReadWriteMany"
+)
+
+// AttachOptions captures everything the flex driver and controller need to process an
+// attach/detach/mount request. It is marshalled to/from JSON across the Unix domain socket RPC
+// between the driver script and the controller.
+type AttachOptions struct {
+	Image        string     `json:"image"`
+	Pool         string     `json:"pool"`
+	ClusterName  string     `json:"clusterNamespace"`
+	StorageClass string     `json:"storageClass"`
+	VolumeName   string     `json:"volumeName"`
+	Pod          string     `json:"pod"`
+	PodID        string     `json:"podID"`
+	PodNamespace string     `json:"podNamespace"`
+	MountDir     string     `json:"mountDir"`
+	RW           string     `json:"rw"`
+	AccessMode   AccessMode `json:"accessMode"`
+	// SubPath is the volumeMounts.subPath requested by the pod, relative to the volume root.
+	// It is validated by resolveAndLockSubPath before being used as a bind-mount source so a
+	// pod can't request e.g. "../../etc" to escape the volume.
+	SubPath string `json:"subPath"`
+}
+
+// LogMessage carries a log line from the flex driver script back to the controller, which
+// writes it under the driverLogger so driver output ends up in the agent's own logs.
+type LogMessage struct {
+	Message string `json:"message"`
+	IsError bool   `json:"isError"`
+}
+
+// VolumeManager attaches/detaches the underlying storage for a volume. RBD-backed storage
+// classes and CephFS-backed storage classes each get their own implementation, selected per
+// storage class by the controller.
+type VolumeManager interface {
+	Attach(image, pool, clusterName string) (string, error)
+	Detach(image, pool, clusterName string) error
+}